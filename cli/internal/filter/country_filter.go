@@ -21,138 +21,882 @@
 package filter
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// defaultCacheSize and defaultCacheTTL bound the decision cache when Config
+// doesn't specify one: a short TTL keeps hot clients (e.g. a TURN relay
+// seeing repeated connections) off the MMDB/mutex path without letting rule
+// changes go unnoticed for long.
+const (
+	defaultCacheSize = 4096
+	defaultCacheTTL  = 30 * time.Second
+
+	counterShards = 16
+)
+
+// Logger is the subset of *slog.Logger that CountryFilter needs. It lets
+// callers plug in their own structured logger; the zero value of Config
+// falls back to slog.Default().
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var (
+	decisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "conduit_filter_decisions_total",
+		Help: "Total number of filter decisions, labeled by outcome and country.",
+	}, []string{"decision", "country"})
+
+	lookupErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "conduit_filter_lookup_errors_total",
+		Help: "Total number of GeoIP database lookup errors.",
+	})
+
+	dbReloadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "conduit_filter_db_reload_timestamp",
+		Help: "Unix timestamp of the last successful GeoIP database reload.",
+	})
+)
+
+// errEmptyReader is returned by a GeoReader whose underlying MMDB file was
+// never configured.
+var errEmptyReader = errors.New("filter: no database loaded for this lookup")
+
+// GeoReader abstracts a single opened MMDB file. CountryFilter talks to its
+// country, ASN, and city databases through this interface so it doesn't
+// care which (if any) of them were actually configured.
+type GeoReader interface {
+	Country(ip net.IP) (*geoip2.Country, error)
+	ASN(ip net.IP) (*geoip2.ASN, error)
+	City(ip net.IP) (*geoip2.City, error)
+	IsEmpty() bool
+	Close() error
+}
+
+// mmdbReader is the default GeoReader, backed by a geoip2.Reader. A nil
+// reader field means the database was never opened, and every lookup
+// returns errEmptyReader instead of panicking.
+type mmdbReader struct {
+	reader *geoip2.Reader
+}
+
+// openMMDB opens path as an MMDB file, or returns an empty mmdbReader when
+// path is "" so unconfigured databases are simply no-ops.
+func openMMDB(path string) (*mmdbReader, error) {
+	if path == "" {
+		return &mmdbReader{}, nil
+	}
+	r, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbReader{reader: r}, nil
+}
+
+// openGeoDB opens path as a GeoReader. It is a variable, rather than a
+// direct call to openMMDB, so tests can substitute a fake opener and
+// exercise NewFilter/reloadIfUpdated without a real MMDB file on disk.
+var openGeoDB = func(path string) (GeoReader, error) {
+	return openMMDB(path)
+}
+
+func (m *mmdbReader) IsEmpty() bool {
+	return m == nil || m.reader == nil
+}
+
+func (m *mmdbReader) Country(ip net.IP) (*geoip2.Country, error) {
+	if m.IsEmpty() {
+		return nil, errEmptyReader
+	}
+	return m.reader.Country(ip)
+}
+
+func (m *mmdbReader) ASN(ip net.IP) (*geoip2.ASN, error) {
+	if m.IsEmpty() {
+		return nil, errEmptyReader
+	}
+	return m.reader.ASN(ip)
+}
+
+func (m *mmdbReader) City(ip net.IP) (*geoip2.City, error) {
+	if m.IsEmpty() {
+		return nil, errEmptyReader
+	}
+	return m.reader.City(ip)
+}
+
+func (m *mmdbReader) Close() error {
+	if m.IsEmpty() {
+		return nil
+	}
+	return m.reader.Close()
+}
+
+// minGeoIPDBSize is the smallest a legitimate MaxMind MMDB file is expected
+// to be. It guards against swapping in a truncated/partial download.
+const minGeoIPDBSize = 1 << 10 // 1 KiB
+
+// defaultReloadInterval is how often the mtime watcher checks the database
+// file for updates when the caller does not specify one.
+const defaultReloadInterval = time.Minute
+
+// ruleAction is the decision a CIDR rule forces once it matches an IP.
+type ruleAction int
+
+const (
+	ruleAllow ruleAction = iota
+	ruleBlock
+)
+
+// cidrRule is a single per-IP override installed via AllowIP/BlockIP.
+type cidrRule struct {
+	network *net.IPNet
+	action  ruleAction
+}
+
+// cidrRules holds the per-IP overrides, split by address family so a v4
+// lookup never has to skip over v6 entries and vice versa. Within each
+// family, rules are kept sorted by prefix length (most specific first) so
+// the first match found is always the longest matching prefix.
+//
+// lookup is an O(n) scan over its family's slice rather than a radix/trie
+// walk, so it's fine for the handful of operator-installed overrides this
+// is meant for, but it will stop scaling once a deployment's CIDR list
+// grows into the hundreds, which matters since this runs on every
+// cache-miss. Worth revisiting as a trie if that ever becomes the norm.
+type cidrRules struct {
+	v4 []cidrRule
+	v6 []cidrRule
+}
+
+// add inserts a new rule for cidr, keeping the family's slice sorted by
+// prefix length descending.
+func (r *cidrRules) add(cidr string, action ruleAction) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+
+	list := &r.v4
+	if network.IP.To4() == nil {
+		list = &r.v6
+	}
+
+	key := network.String()
+	for i, rule := range *list {
+		if rule.network.String() == key {
+			// Re-adding the same network (e.g. AllowIP then BlockIP for
+			// the same CIDR) replaces the rule instead of shadowing it.
+			(*list)[i].action = action
+			return nil
+		}
+	}
+
+	// Prepend, then stable-sort by prefix length: sort.SliceStable keeps
+	// equal-length rules in their current relative order, so putting the
+	// new rule first here means ties resolve in favor of whichever rule
+	// was added most recently.
+	*list = append([]cidrRule{{network: network, action: action}}, (*list)...)
+	sort.SliceStable(*list, func(i, j int) bool {
+		iOnes, _ := (*list)[i].network.Mask.Size()
+		jOnes, _ := (*list)[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+	return nil
+}
+
+// lookup returns the action of the longest matching prefix for ip, if any.
+func (r *cidrRules) lookup(ip net.IP) (action ruleAction, network *net.IPNet, matched bool) {
+	list := r.v4
+	if ip.To4() == nil {
+		list = r.v6
+	}
+	for _, rule := range list {
+		if rule.network.Contains(ip) {
+			return rule.action, rule.network, true
+		}
+	}
+	return 0, nil, false
+}
+
+// Decision describes the outcome of a single IsAllowed call, including
+// which rule produced it and the enriched geo record, so callers can log
+// or audit the reasoning (e.g. for TURN/relay analytics).
+type Decision struct {
+	Allowed     bool
+	Reason      string
+	MatchedRule string
+	Country     string
+	ASN         uint
+	ASOrg       string
+	City        string
+	Region      string
+}
+
+// Config configures NewFilter. When CountryDB is empty no country database
+// is opened and every IP that reaches the GeoIP step is blocked as
+// "unknown-country"; ASNDB and CityDB are optional and enable ASN/city
+// enrichment and ASN-based filtering when set.
+type Config struct {
+	CountryDB string
+	ASNDB     string
+	CityDB    string
+
+	AllowedCountries []string
+	AllowedASNs      []uint
+	BlockedASNs      []uint
+
+	// Logger receives the filter's structured logs. Defaults to
+	// slog.Default() when nil.
+	Logger Logger
+
+	// CacheSize and CacheTTL bound the decision cache. Zero values fall
+	// back to defaultCacheSize/defaultCacheTTL.
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+// Stats is the allowed/blocked breakdown for a single country, as returned
+// by GetStatsByCountry.
+type Stats struct {
+	Allowed int64
+	Blocked int64
+}
+
+// CacheStats reports the decision cache's current occupancy and hit rate.
+type CacheStats struct {
+	Size   int
+	Hits   int64
+	Misses int64
+}
+
+// shardedCounter is an int64 counter split across a fixed number of
+// shards, each updated independently, so concurrent lookups for different
+// IPs don't contend on the same cache line the way a single atomic (or a
+// mutex-guarded int64) would. The shard is picked from the IP being
+// counted, which is already at hand on every call site.
+type shardedCounter struct {
+	shards [counterShards]atomic.Int64
+}
+
+func (c *shardedCounter) Add(key string, delta int64) {
+	c.shards[shardIndex(key)].Add(delta)
+}
+
+func (c *shardedCounter) Sum() int64 {
+	var total int64
+	for i := range c.shards {
+		total += c.shards[i].Load()
+	}
+	return total
+}
+
+// shardIndex is an allocation-free FNV-1a over key, reduced to a shard.
+func shardIndex(key string) uint32 {
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % counterShards
+}
+
+// countryCounter is the per-country allowed/blocked tally backing
+// GetStatsByCountry, updated with atomics instead of CountryFilter.mu so
+// recording a decision never blocks on rule changes or other lookups.
+type countryCounter struct {
+	allowed atomic.Int64
+	blocked atomic.Int64
+}
+
 // CountryFilter filters connections based on country
 type CountryFilter struct {
-	db               *geoip2.Reader
+	countryDB        GeoReader
+	asnDB            GeoReader
+	cityDB           GeoReader
 	allowedCountries map[string]bool
+	blockedCountries map[string]bool
+	allowedASNs      map[uint]bool
+	blockedASNs      map[uint]bool
+	blockByDefault   bool
+	cidrRules        cidrRules
+	relayRanges      []*net.IPNet
+	logger           Logger
 	mu               sync.RWMutex
 
-	// Stats
-	allowedCount int64
-	blockedCount int64
-	relayCount   int64
+	// Stats. These are updated without mu so a connection storm of
+	// lookups never serializes on the same lock used for rule changes.
+	allowedCount shardedCounter
+	blockedCount shardedCounter
+	relayCount   shardedCounter
+	countryStats sync.Map // country string -> *countryCounter
+
+	// Decision cache: short-TTL LRU keyed by IP so repeat lookups from the
+	// same client skip both the MMDB calls and the mu.RLock above.
+	cache       *expirable.LRU[string, Decision]
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	// Hot-reload of the GeoIP country database
+	dbPath         string
+	reloadInterval time.Duration
+	lastModTime    time.Time
+	stopCh         chan struct{}
+	stopped        sync.WaitGroup
 }
 
-// NewCountryFilter creates a new country filter
-func NewCountryFilter(dbPath string, allowedCountries []string) (*CountryFilter, error) {
-	fmt.Println("")
-	fmt.Println("╔════════════════════════════════════════════════════════════════╗")
-	fmt.Println("║           COUNTRY FILTER INITIALIZATION                        ║")
-	fmt.Println("╚════════════════════════════════════════════════════════════════╝")
-	fmt.Printf("[FILTER-INIT] Starting country filter initialization...\n")
-	fmt.Printf("[FILTER-INIT] GeoIP database path: %s\n", dbPath)
-	fmt.Printf("[FILTER-INIT] Allowed countries received: %v\n", allowedCountries)
-	fmt.Printf("[FILTER-INIT] Number of allowed countries: %d\n", len(allowedCountries))
-
-	fmt.Printf("[FILTER-INIT] Opening GeoIP database...\n")
-	db, err := geoip2.Open(dbPath)
+// countryCounterFor returns the counter for country, creating it on first
+// use. Safe for concurrent use without CountryFilter.mu.
+func (f *CountryFilter) countryCounterFor(country string) *countryCounter {
+	if v, ok := f.countryStats.Load(country); ok {
+		return v.(*countryCounter)
+	}
+	actual, _ := f.countryStats.LoadOrStore(country, &countryCounter{})
+	return actual.(*countryCounter)
+}
+
+// NewFilter creates a filter from cfg, opening the country database plus
+// whichever of ASNDB/CityDB are set. ASN and city lookups are simply
+// skipped (GeoReader.IsEmpty) when their database was not configured.
+func NewFilter(cfg Config) (*CountryFilter, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Info("initializing country filter",
+		"country_db", cfg.CountryDB, "asn_db", cfg.ASNDB, "city_db", cfg.CityDB,
+		"allowed_countries", cfg.AllowedCountries)
+
+	countryDB, err := openGeoDB(cfg.CountryDB)
+	if err != nil {
+		logger.Error("failed to open country database", "path", cfg.CountryDB, "error", err)
+		return nil, err
+	}
+	asnDB, err := openGeoDB(cfg.ASNDB)
+	if err != nil {
+		countryDB.Close()
+		logger.Error("failed to open ASN database", "path", cfg.ASNDB, "error", err)
+		return nil, err
+	}
+	cityDB, err := openGeoDB(cfg.CityDB)
 	if err != nil {
-		fmt.Printf("[FILTER-INIT] ERROR: Failed to open GeoIP database: %v\n", err)
+		countryDB.Close()
+		asnDB.Close()
+		logger.Error("failed to open city database", "path", cfg.CityDB, "error", err)
 		return nil, err
 	}
-	fmt.Printf("[FILTER-INIT] GeoIP database loaded successfully\n")
 
 	allowed := make(map[string]bool)
-	fmt.Printf("[FILTER-INIT] Building allowed countries map:\n")
-	for i, cc := range allowedCountries {
+	for _, cc := range cfg.AllowedCountries {
 		allowed[cc] = true
-		fmt.Printf("[FILTER-INIT]   %d. Country code: %s -> ALLOWED\n", i+1, cc)
-	}
-
-	fmt.Println("")
-	fmt.Println("╔════════════════════════════════════════════════════════════════╗")
-	fmt.Println("║           FILTER RULES SUMMARY                                 ║")
-	fmt.Println("╠════════════════════════════════════════════════════════════════╣")
-	fmt.Printf("║  Allowed countries: %-42v ║\n", allowedCountries)
-	fmt.Println("║  Private IPs (TURN relays): ALWAYS ALLOWED                     ║")
-	fmt.Println("║  Unknown country IPs: BLOCKED                                  ║")
-	fmt.Println("║  All other countries: BLOCKED                                  ║")
-	fmt.Println("╚════════════════════════════════════════════════════════════════╝")
-	fmt.Println("")
-	fmt.Printf("[FILTER-INIT] Country filter initialized and ready!\n")
-	fmt.Printf("[FILTER-INIT] Waiting for incoming connections...\n")
-	fmt.Println("")
+	}
+	allowedASNs := make(map[uint]bool)
+	for _, asn := range cfg.AllowedASNs {
+		allowedASNs[asn] = true
+	}
+	blockedASNs := make(map[uint]bool)
+	for _, asn := range cfg.BlockedASNs {
+		blockedASNs[asn] = true
+	}
+
+	var lastModTime time.Time
+	if info, statErr := os.Stat(cfg.CountryDB); statErr == nil {
+		lastModTime = info.ModTime()
+	}
+
+	cacheSize := cfg.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultCacheSize
+	}
+	cacheTTL := cfg.CacheTTL
+	if cacheTTL <= 0 {
+		cacheTTL = defaultCacheTTL
+	}
+
+	logger.Info("country filter ready",
+		"allowed_countries", len(allowed), "blocked_asns", len(blockedASNs), "allowed_asns", len(allowedASNs),
+		"cache_size", cacheSize, "cache_ttl", cacheTTL)
 
 	return &CountryFilter{
-		db:               db,
+		countryDB:        countryDB,
+		asnDB:            asnDB,
+		cityDB:           cityDB,
 		allowedCountries: allowed,
+		blockedCountries: make(map[string]bool),
+		allowedASNs:      allowedASNs,
+		blockedASNs:      blockedASNs,
+		blockByDefault:   true,
+		logger:           logger,
+		cache:            expirable.NewLRU[string, Decision](cacheSize, nil, cacheTTL),
+		dbPath:           cfg.CountryDB,
+		lastModTime:      lastModTime,
 	}, nil
 }
 
-// IsAllowed checks if an IP is allowed based on country
-// Returns: allowed (bool), countryCode (string), isRelay (bool for private IPs)
-func (f *CountryFilter) IsAllowed(ipStr string) (bool, string, bool) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Printf("%s [FILTER-DEBUG] IsAllowed called with IP: %s\n", timestamp, ipStr)
+// NewCountryFilter creates a new country filter backed by a single country
+// database. It is a convenience wrapper around NewFilter for callers that
+// don't need ASN or city enrichment.
+func NewCountryFilter(dbPath string, allowedCountries []string) (*CountryFilter, error) {
+	return NewFilter(Config{CountryDB: dbPath, AllowedCountries: allowedCountries})
+}
+
+// AllowIP installs a per-IP override that allows cidr regardless of its
+// GeoIP country, taking precedence over any country rule. It is evaluated
+// before the GeoIP lookup, so it also applies to IPs whose country cannot
+// be determined.
+func (f *CountryFilter) AllowIP(cidr string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.cidrRules.add(cidr, ruleAllow); err != nil {
+		return err
+	}
+	f.cache.Purge()
+	return nil
+}
+
+// BlockIP installs a per-IP override that blocks cidr regardless of its
+// GeoIP country, taking precedence over any country rule.
+func (f *CountryFilter) BlockIP(cidr string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.cidrRules.add(cidr, ruleBlock); err != nil {
+		return err
+	}
+	f.cache.Purge()
+	return nil
+}
+
+// AllowCountry adds cc to the allow-list, removing it from the block-list
+// if present.
+func (f *CountryFilter) AllowCountry(cc string) {
+	cc = strings.ToUpper(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allowedCountries[cc] = true
+	delete(f.blockedCountries, cc)
+	f.cache.Purge()
+}
+
+// BlockCountry adds cc to the block-list, removing it from the allow-list
+// if present. Blocked countries are rejected even when BlockByDefault is
+// disabled.
+func (f *CountryFilter) BlockCountry(cc string) {
+	cc = strings.ToUpper(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blockedCountries[cc] = true
+	delete(f.allowedCountries, cc)
+	f.cache.Purge()
+}
+
+// SetBlockByDefault controls what happens to a country that is on neither
+// the allow-list nor the block-list. It defaults to true (block), matching
+// the filter's original allow-list-only behavior.
+func (f *CountryFilter) SetBlockByDefault(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blockByDefault = enabled
+	f.cache.Purge()
+}
+
+// NewCountryFilterWithReload creates a country filter that additionally
+// watches dbPath for updates. Every interval (defaulting to
+// defaultReloadInterval when <= 0), it stats the file and, if the
+// modification time has advanced since the last successful load, opens a
+// fresh geoip2.Reader and atomically swaps it in. This lets operators drop
+// in updated GeoLite2 releases without restarting conduit. Callers must
+// invoke Stop() to release the watcher goroutine.
+func NewCountryFilterWithReload(dbPath string, allowedCountries []string, interval time.Duration) (*CountryFilter, error) {
+	f, err := NewCountryFilter(dbPath, allowedCountries)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	f.reloadInterval = interval
+	f.stopCh = make(chan struct{})
+
+	f.stopped.Add(1)
+	go f.watchDB()
+
+	return f, nil
+}
+
+// watchDB periodically checks dbPath for a newer modification time and
+// reloads the GeoIP database in place. Transient stat/open errors are
+// logged and the existing database keeps serving lookups.
+func (f *CountryFilter) watchDB() {
+	defer f.stopped.Done()
+
+	ticker := time.NewTicker(f.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-ticker.C:
+			f.reloadIfUpdated()
+		}
+	}
+}
+
+// reloadIfUpdated opens a new geoip2.Reader and swaps it in if dbPath has
+// been modified since the last successful load.
+func (f *CountryFilter) reloadIfUpdated() {
+	info, err := os.Stat(f.dbPath)
+	if err != nil {
+		lookupErrorsTotal.Inc()
+		f.logger.Error("failed to stat GeoIP database", "path", f.dbPath, "error", err)
+		return
+	}
+
+	if !info.ModTime().After(f.lastModTime) {
+		return
+	}
+
+	if info.Size() < minGeoIPDBSize {
+		f.logger.Error("GeoIP database looks truncated, keeping current database", "path", f.dbPath, "size", info.Size())
+		return
+	}
+
+	newDB, err := openGeoDB(f.dbPath)
+	if err != nil {
+		lookupErrorsTotal.Inc()
+		f.logger.Error("failed to open updated GeoIP database, keeping current database", "path", f.dbPath, "error", err)
+		return
+	}
+
+	f.mu.Lock()
+	oldDB := f.countryDB
+	f.countryDB = newDB
+	f.lastModTime = info.ModTime()
+	f.mu.Unlock()
+
+	if err := oldDB.Close(); err != nil {
+		f.logger.Warn("failed to close previous GeoIP database", "error", err)
+	}
+	f.cache.Purge()
+	dbReloadTimestamp.Set(float64(time.Now().Unix()))
+	f.logger.Info("reloaded GeoIP database, decision cache purged", "path", f.dbPath, "mtime", info.ModTime())
+}
+
+// Stop cancels the mtime watcher started by NewCountryFilterWithReload. It
+// is a no-op for filters created with NewCountryFilter.
+func (f *CountryFilter) Stop() {
+	if f.stopCh == nil {
+		return
+	}
+	close(f.stopCh)
+	f.stopped.Wait()
+}
+
+// record updates the sharded global and per-country counters plus the
+// conduit_filter_decisions_total metric for a single decision. It touches
+// none of CountryFilter.mu, so recording never contends with rule changes
+// or other lookups.
+func (f *CountryFilter) record(ipStr string, allowed bool, country string) {
+	if allowed {
+		f.allowedCount.Add(ipStr, 1)
+	} else {
+		f.blockedCount.Add(ipStr, 1)
+	}
+
+	cc := f.countryCounterFor(country)
+	label := "blocked"
+	if allowed {
+		label = "allowed"
+		cc.allowed.Add(1)
+	} else {
+		cc.blocked.Add(1)
+	}
+	decisionsTotal.WithLabelValues(label, country).Inc()
+}
+
+// recordRelay records a private-IP/TURN-relay decision. Relay traffic has
+// always been tracked separately from the allowed counter (see GetStats),
+// so it bypasses record.
+func (f *CountryFilter) recordRelay(ipStr string) {
+	f.relayCount.Add(ipStr, 1)
+	f.countryCounterFor("RELAY").allowed.Add(1)
+	decisionsTotal.WithLabelValues("allowed", "RELAY").Inc()
+}
+
+// recordCached replays the counters for a decision served from the cache,
+// without repeating the GeoIP/ASN/city lookups that produced it.
+func (f *CountryFilter) recordCached(ipStr string, d Decision) {
+	if d.Reason == "relay" {
+		f.recordRelay(ipStr)
+		return
+	}
+	f.record(ipStr, d.Allowed, d.Country)
+}
+
+// IsAllowed checks whether ipStr should be let through and returns a
+// Decision describing why: a matching per-IP CIDR override, the TURN
+// relay private-IP exception, or the country/ASN allow/block rules.
+//
+// Repeat lookups for the same IP within the cache TTL skip the MMDB calls
+// and the f.mu.RLock below entirely; everything else only ever takes a
+// read lock, since the hot path never needs to mutate shared rule state.
+func (f *CountryFilter) IsAllowed(ipStr string) Decision {
+	if cached, ok := f.cache.Get(ipStr); ok {
+		f.cacheHits.Add(1)
+		f.recordCached(ipStr, cached)
+		return cached
+	}
+	f.cacheMisses.Add(1)
 
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		// Invalid IP, block it
-		f.mu.Lock()
-		f.blockedCount++
-		f.mu.Unlock()
-		fmt.Printf("%s [FILTER-DEBUG] Invalid IP format: %s - BLOCKED\n", timestamp, ipStr)
-		return false, "", false
+		f.record(ipStr, false, "INVALID")
+		f.logger.Debug("invalid IP format, blocking", "ip", ipStr)
+		return Decision{Allowed: false, Reason: "invalid-ip", Country: "INVALID"}
 	}
 
-	// Allow private/loopback IPs (TURN relay connections)
-	if isPrivateIP(ip) {
-		f.mu.Lock()
-		f.relayCount++
-		total := f.relayCount
-		f.mu.Unlock()
-		fmt.Printf("%s [FILTER-DEBUG] Private/Relay IP: %s - ALLOWED (total relays: %d)\n", timestamp, ipStr, total)
-		return true, "RELAY", true
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Per-IP CIDR overrides win over everything else, including GeoIP.
+	if action, network, matched := f.cidrRules.lookup(ip); matched {
+		allowed := action == ruleAllow
+		reason := "cidr-block"
+		if allowed {
+			reason = "cidr-allow"
+		}
+		d := Decision{Allowed: allowed, Reason: reason, MatchedRule: network.String(), Country: "CIDR"}
+		f.record(ipStr, allowed, "CIDR")
+		f.logger.Debug("IP matched CIDR rule", "ip", ipStr, "rule", network.String(), "reason", reason)
+		f.cache.Add(ipStr, d)
+		return d
 	}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	// Allow private/loopback IPs (TURN relay connections)
+	if f.isPrivateIP(ip) {
+		d := Decision{Allowed: true, Reason: "relay", Country: "RELAY"}
+		f.recordRelay(ipStr)
+		f.logger.Debug("private/relay IP allowed", "ip", ipStr)
+		f.cache.Add(ipStr, d)
+		return d
+	}
 
-	record, err := f.db.Country(ip)
-	if err != nil || record.Country.IsoCode == "" {
+	geoRecord, err := f.countryDB.Country(ip)
+	if err != nil || geoRecord.Country.IsoCode == "" {
 		// Can't determine country, block it
-		f.blockedCount++
-		fmt.Printf("%s [FILTER-DEBUG] GeoIP lookup failed for %s (err: %v) - BLOCKED (total blocked: %d)\n", timestamp, ipStr, err, f.blockedCount)
-		return false, "UNKNOWN", false
+		lookupErrorsTotal.Inc()
+		d := Decision{Allowed: false, Reason: "unknown-country", Country: "UNKNOWN"}
+		f.record(ipStr, false, "UNKNOWN")
+		f.logger.Debug("GeoIP country lookup failed, blocking", "ip", ipStr, "error", err)
+		f.cache.Add(ipStr, d)
+		return d
+	}
+
+	countryCode := geoRecord.Country.IsoCode
+
+	// ASN/city enrichment, used both for logging and ASN-based filtering.
+	var asn uint
+	var asOrg string
+	if !f.asnDB.IsEmpty() {
+		if asnRecord, asnErr := f.asnDB.ASN(ip); asnErr == nil {
+			asn = asnRecord.AutonomousSystemNumber
+			asOrg = asnRecord.AutonomousSystemOrganization
+		}
+	}
+	var city, region string
+	if !f.cityDB.IsEmpty() {
+		if cityRecord, cityErr := f.cityDB.City(ip); cityErr == nil {
+			city = cityRecord.City.Names["en"]
+			if len(cityRecord.Subdivisions) > 0 {
+				region = cityRecord.Subdivisions[0].Names["en"]
+			}
+		}
+	}
+
+	logFields := []any{"ip", ipStr, "country", countryCode, "asn", asn, "as_org", asOrg, "city", city, "region", region}
+
+	decide := func(allowed bool, reason string) Decision {
+		d := Decision{Allowed: allowed, Reason: reason, Country: countryCode, ASN: asn, ASOrg: asOrg, City: city, Region: region}
+		f.record(ipStr, allowed, countryCode)
+		f.cache.Add(ipStr, d)
+		return d
+	}
+
+	if asn != 0 && f.blockedASNs[asn] {
+		f.logger.Debug("blocking IP on explicit ASN block", logFields...)
+		return decide(false, "asn-block")
+	}
+
+	if f.blockedCountries[countryCode] {
+		f.logger.Debug("blocking IP on explicit country block", logFields...)
+		return decide(false, "country-block")
 	}
 
-	countryCode := record.Country.IsoCode
-	countryName := record.Country.Names["en"]
 	if f.allowedCountries[countryCode] {
-		f.allowedCount++
-		fmt.Printf("%s [FILTER-DEBUG] IP %s is from %s (%s) - ALLOWED (total allowed: %d)\n", timestamp, ipStr, countryName, countryCode, f.allowedCount)
-		return true, countryCode, false
+		f.logger.Debug("allowing IP on country allow-list", logFields...)
+		return decide(true, "country-allow")
+	}
+
+	if asn != 0 && f.allowedASNs[asn] {
+		f.logger.Debug("allowing IP on explicit ASN allow", logFields...)
+		return decide(true, "asn-allow")
+	}
+
+	if !f.blockByDefault {
+		f.logger.Debug("allowing IP by default", logFields...)
+		return decide(true, "default-allow")
 	}
 
-	f.blockedCount++
-	fmt.Printf("%s [FILTER-DEBUG] IP %s is from %s (%s) - BLOCKED (total blocked: %d)\n", timestamp, ipStr, countryName, countryCode, f.blockedCount)
-	return false, countryCode, false
+	f.logger.Debug("blocking IP by default", logFields...)
+	return decide(false, "default-block")
 }
 
 // GetStats returns the current filter statistics
 func (f *CountryFilter) GetStats() (allowed, blocked, relay int64) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	return f.allowedCount, f.blockedCount, f.relayCount
+	return f.allowedCount.Sum(), f.blockedCount.Sum(), f.relayCount.Sum()
+}
+
+// GetStatsByCountry returns a snapshot of the allowed/blocked breakdown per
+// country code, plus the pseudo-codes "RELAY" (private/relay IPs), "UNKNOWN"
+// (GeoIP lookup failed), "CIDR" (matched an AllowIP/BlockIP override), and
+// "INVALID" (unparseable ipStr), so operators can see which countries
+// actually drive the global counters.
+func (f *CountryFilter) GetStatsByCountry() map[string]Stats {
+	out := make(map[string]Stats)
+	f.countryStats.Range(func(key, value any) bool {
+		cc := value.(*countryCounter)
+		out[key.(string)] = Stats{Allowed: cc.allowed.Load(), Blocked: cc.blocked.Load()}
+		return true
+	})
+	return out
+}
+
+// CacheStats reports the decision cache's current size and hit/miss
+// counts since the filter was created.
+func (f *CountryFilter) CacheStats() CacheStats {
+	return CacheStats{
+		Size:   f.cache.Len(),
+		Hits:   f.cacheHits.Load(),
+		Misses: f.cacheMisses.Load(),
+	}
 }
 
-// Close closes the GeoIP database
+// Close closes all configured GeoIP databases.
 func (f *CountryFilter) Close() error {
-	if f.db != nil {
-		return f.db.Close()
+	var errs []error
+	if err := f.countryDB.Close(); err != nil {
+		errs = append(errs, err)
 	}
-	return nil
+	if err := f.asnDB.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := f.cityDB.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// PrivateRanges are the networks treated as private/internal TURN-relay
+// traffic rather than run through GeoIP. Beyond RFC1918 and the IPv4/IPv6
+// loopback and link-local ranges that net.IP.IsPrivate()/IsLoopback() cover
+// reasonably well, it adds RFC 6598 CGNAT space (seen in front of carrier
+// NAT on TURN relays), RFC 4193 IPv6 ULA, the IPv4/IPv6 documentation
+// ranges operators sometimes use for internal test fixtures, and
+// link-local multicast so discovery traffic (e.g. mDNS) isn't sent to
+// GeoIP and blocked as an unknown country.
+var PrivateRanges = mustParseCIDRs(
+	// RFC 1918 private IPv4
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	// RFC 6598 carrier-grade NAT
+	"100.64.0.0/10",
+	// IPv4 loopback and link-local
+	"127.0.0.0/8", "169.254.0.0/16",
+	// IPv4 documentation ranges (RFC 5737)
+	"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24",
+	// IPv6 loopback, link-local, and RFC 4193 unique local addresses
+	"::1/128", "fe80::/10", "fc00::/7",
+	// IPv6 documentation range (RFC 3849)
+	"2001:db8::/32",
+	// IPv4/IPv6 link-local multicast (e.g. mDNS), matching the
+	// ip.IsLinkLocalMulticast() coverage the old isPrivateIP relied on
+	"224.0.0.0/24", "ff02::/16",
+)
+
+// mustParseCIDRs parses each cidr into a *net.IPNet. It panics on a
+// malformed entry, since PrivateRanges is only ever built from constants
+// at package init.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Sprintf("filter: invalid built-in CIDR %q: %v", cidr, err))
+		}
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// normalizeIP returns ip in its most specific form (4-byte for IPv4,
+// including IPv4-mapped IPv6 addresses, 16-byte otherwise) so range
+// membership checks behave the same regardless of how the address was
+// represented.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// isPrivateIP reports whether ip is private/internal TURN-relay traffic:
+// one of the built-in PrivateRanges, or a CIDR installed with
+// AddRelayCIDR. Callers must hold at least f.mu.RLock() for the latter.
+func (f *CountryFilter) isPrivateIP(ip net.IP) bool {
+	normalized := normalizeIP(ip)
+	for _, network := range PrivateRanges {
+		if network.Contains(normalized) {
+			return true
+		}
+	}
+	for _, network := range f.relayRanges {
+		if network.Contains(normalized) {
+			return true
+		}
+	}
+	return false
 }
 
-// isPrivateIP checks if an IP is private/internal
-func isPrivateIP(ip net.IP) bool {
-	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+// AddRelayCIDR whitelists cidr as TURN-relay traffic: matching IPs are
+// allowed and reported as country "RELAY" without ever reaching GeoIP,
+// exactly like the built-in PrivateRanges.
+func (f *CountryFilter) AddRelayCIDR(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid relay CIDR %q: %w", cidr, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.relayRanges = append(f.relayRanges, network)
+	f.cache.Purge()
+	return nil
 }
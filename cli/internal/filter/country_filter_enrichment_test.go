@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2026, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package filter
+
+import (
+	"testing"
+)
+
+// withFakeGeoDBs configures openGeoDB to hand back a distinct fakeGeoReader
+// for each of the country/ASN/city database paths used by the returned
+// Config, so IsAllowed can be exercised without a real MMDB file.
+func withFakeGeoDBs(t *testing.T, country, asn, city *fakeGeoReader) Config {
+	t.Helper()
+	withFakeOpener(t, func(path string) (GeoReader, error) {
+		switch path {
+		case "country.mmdb":
+			return country, nil
+		case "asn.mmdb":
+			return asn, nil
+		case "city.mmdb":
+			return city, nil
+		}
+		return &fakeGeoReader{empty: true}, nil
+	})
+	return Config{CountryDB: "country.mmdb", ASNDB: "asn.mmdb", CityDB: "city.mmdb"}
+}
+
+func TestASNCityEnrichment(t *testing.T) {
+	cfg := withFakeGeoDBs(t,
+		&fakeGeoReader{country: "US"},
+		&fakeGeoReader{asn: 15169, asOrg: "Google LLC"},
+		&fakeGeoReader{city: "Mountain View", region: "California"},
+	)
+
+	f, err := NewFilter(cfg)
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	defer f.Close()
+
+	d := f.IsAllowed("8.8.8.8")
+	if d.ASN != 15169 || d.ASOrg != "Google LLC" {
+		t.Fatalf("got ASN=%d ASOrg=%q, want 15169/%q", d.ASN, d.ASOrg, "Google LLC")
+	}
+	if d.City != "Mountain View" || d.Region != "California" {
+		t.Fatalf("got City=%q Region=%q, want Mountain View/California", d.City, d.Region)
+	}
+}
+
+func TestASNBlockOverridesCountryAllow(t *testing.T) {
+	cfg := withFakeGeoDBs(t,
+		&fakeGeoReader{country: "DE"},
+		&fakeGeoReader{asn: 64500},
+		&fakeGeoReader{empty: true},
+	)
+	cfg.AllowedCountries = []string{"DE"}
+	cfg.BlockedASNs = []uint{64500}
+
+	f, err := NewFilter(cfg)
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	defer f.Close()
+
+	if d := f.IsAllowed("8.8.8.8"); d.Allowed || d.Reason != "asn-block" {
+		t.Fatalf("got Allowed=%v Reason=%q, want a blocked asn-block decision (ASN block must win over country allow)", d.Allowed, d.Reason)
+	}
+}
+
+func TestASNAllowOverridesDefaultBlock(t *testing.T) {
+	cfg := withFakeGeoDBs(t,
+		&fakeGeoReader{country: "DE"},
+		&fakeGeoReader{asn: 64500},
+		&fakeGeoReader{empty: true},
+	)
+	cfg.AllowedASNs = []uint{64500}
+
+	f, err := NewFilter(cfg)
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	defer f.Close()
+
+	if d := f.IsAllowed("8.8.8.8"); !d.Allowed || d.Reason != "asn-allow" {
+		t.Fatalf("got Allowed=%v Reason=%q, want an allowed asn-allow decision", d.Allowed, d.Reason)
+	}
+}
+
+func TestEnrichmentSkippedWhenDBEmpty(t *testing.T) {
+	cfg := withFakeGeoDBs(t,
+		&fakeGeoReader{country: "US"},
+		&fakeGeoReader{empty: true},
+		&fakeGeoReader{empty: true},
+	)
+
+	f, err := NewFilter(cfg)
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	defer f.Close()
+
+	d := f.IsAllowed("8.8.8.8")
+	if d.ASN != 0 || d.ASOrg != "" || d.City != "" || d.Region != "" {
+		t.Fatalf("got %+v, want no ASN/city enrichment when those databases are empty", d)
+	}
+}
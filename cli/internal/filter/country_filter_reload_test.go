@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2026, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package filter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// fakeGeoReader is a GeoReader test double for the country/ASN/City
+// databases, so tests can exercise decision logic, enrichment, and
+// hot-reload without needing a real MMDB file on disk.
+type fakeGeoReader struct {
+	country string
+	asn     uint
+	asOrg   string
+	city    string
+	region  string
+	empty   bool
+	err     error
+}
+
+func (r *fakeGeoReader) IsEmpty() bool { return r.empty }
+
+func (r *fakeGeoReader) Country(net.IP) (*geoip2.Country, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	rec := &geoip2.Country{}
+	rec.Country.IsoCode = r.country
+	return rec, nil
+}
+
+func (r *fakeGeoReader) ASN(net.IP) (*geoip2.ASN, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &geoip2.ASN{AutonomousSystemNumber: r.asn, AutonomousSystemOrganization: r.asOrg}, nil
+}
+
+func (r *fakeGeoReader) City(net.IP) (*geoip2.City, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	rec := &geoip2.City{}
+	rec.City.Names = map[string]string{"en": r.city}
+	if r.region != "" {
+		rec.Subdivisions = append(rec.Subdivisions, struct {
+			Names     map[string]string `maxminddb:"names"`
+			IsoCode   string            `maxminddb:"iso_code"`
+			GeoNameID uint              `maxminddb:"geoname_id"`
+		}{Names: map[string]string{"en": r.region}})
+	}
+	return rec, nil
+}
+
+func (r *fakeGeoReader) Close() error { return nil }
+
+// withFakeOpener substitutes openGeoDB for the duration of the test, so
+// NewFilter/reloadIfUpdated can be exercised without a real MMDB file.
+func withFakeOpener(t *testing.T, open func(path string) (GeoReader, error)) {
+	t.Helper()
+	original := openGeoDB
+	openGeoDB = open
+	t.Cleanup(func() { openGeoDB = original })
+}
+
+// writeDBFile writes a size-byte placeholder file, standing in for a GeoIP
+// database on disk for the mtime/size checks in reloadIfUpdated.
+func writeDBFile(t *testing.T, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestReloadIfUpdatedSwapsInNewDB(t *testing.T) {
+	path := writeDBFile(t, minGeoIPDBSize)
+	withFakeOpener(t, func(string) (GeoReader, error) { return &fakeGeoReader{country: "US"}, nil })
+
+	f, err := NewCountryFilter(path, nil)
+	if err != nil {
+		t.Fatalf("NewCountryFilter: %v", err)
+	}
+	defer f.Close()
+
+	f.IsAllowed("8.8.8.8") // populate the decision cache before the reload
+
+	newReader := &fakeGeoReader{country: "CA"}
+	openGeoDB = func(string) (GeoReader, error) { return newReader, nil }
+
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	f.reloadIfUpdated()
+
+	if f.countryDB != GeoReader(newReader) {
+		t.Fatalf("countryDB was not swapped to the reloaded reader")
+	}
+	if stats := f.CacheStats(); stats.Size != 0 {
+		t.Fatalf("got cache size %d after reload, want 0: reload must purge the decision cache", stats.Size)
+	}
+}
+
+func TestReloadIfUpdatedRejectsTruncatedFile(t *testing.T) {
+	path := writeDBFile(t, minGeoIPDBSize)
+	oldReader := &fakeGeoReader{country: "US"}
+	withFakeOpener(t, func(string) (GeoReader, error) { return oldReader, nil })
+
+	f, err := NewCountryFilter(path, nil)
+	if err != nil {
+		t.Fatalf("NewCountryFilter: %v", err)
+	}
+	defer f.Close()
+
+	openGeoDB = func(string) (GeoReader, error) {
+		t.Fatal("openGeoDB must not be called for a truncated file")
+		return nil, nil
+	}
+
+	if err := os.WriteFile(path, make([]byte, minGeoIPDBSize-1), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	f.reloadIfUpdated()
+
+	if f.countryDB != GeoReader(oldReader) {
+		t.Fatalf("countryDB changed after a truncated file should have been rejected")
+	}
+}
+
+func TestStopTerminatesWatcher(t *testing.T) {
+	path := writeDBFile(t, minGeoIPDBSize)
+	withFakeOpener(t, func(string) (GeoReader, error) { return &fakeGeoReader{}, nil })
+
+	f, err := NewCountryFilterWithReload(path, nil, time.Hour)
+	if err != nil {
+		t.Fatalf("NewCountryFilterWithReload: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop() did not return: the watcher goroutine is likely still running")
+	}
+}
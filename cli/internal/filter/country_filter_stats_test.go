@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2026, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package filter
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeLogger is a Logger test double that records every call, so tests can
+// confirm Config.Logger is actually used instead of falling back to
+// slog.Default().
+type fakeLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *fakeLogger) record(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+": "+msg)
+}
+
+func (l *fakeLogger) Debug(msg string, args ...any) { l.record("debug", msg) }
+func (l *fakeLogger) Info(msg string, args ...any)  { l.record("info", msg) }
+func (l *fakeLogger) Warn(msg string, args ...any)  { l.record("warn", msg) }
+func (l *fakeLogger) Error(msg string, args ...any) { l.record("error", msg) }
+
+func (l *fakeLogger) has(level, msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if m == level+": "+msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCustomLoggerInjection(t *testing.T) {
+	logger := &fakeLogger{}
+	f, err := NewFilter(Config{Logger: logger})
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	defer f.Close()
+
+	if !logger.has("info", "initializing country filter") {
+		t.Fatalf("custom Logger did not receive NewFilter's initialization log; it may still be using slog.Default()")
+	}
+
+	f.IsAllowed("not-an-ip")
+	if !logger.has("debug", "invalid IP format, blocking") {
+		t.Fatalf("custom Logger did not receive IsAllowed's debug log")
+	}
+}
+
+func TestGetStatsByCountry(t *testing.T) {
+	f := newTestFilter(t)
+
+	f.IsAllowed("not-an-ip") // INVALID
+	if err := f.AllowIP("9.9.9.9/32"); err != nil {
+		t.Fatalf("AllowIP: %v", err)
+	}
+	f.IsAllowed("9.9.9.9")  // CIDR
+	f.IsAllowed("10.0.0.1") // RELAY (private)
+	f.IsAllowed("8.8.8.8")  // UNKNOWN (no country DB configured)
+
+	stats := f.GetStatsByCountry()
+	for cc, want := range map[string]Stats{
+		"INVALID": {Blocked: 1},
+		"CIDR":    {Allowed: 1},
+		"RELAY":   {Allowed: 1},
+		"UNKNOWN": {Blocked: 1},
+	} {
+		if got := stats[cc]; got != want {
+			t.Errorf("GetStatsByCountry()[%q] = %+v, want %+v", cc, got, want)
+		}
+	}
+}
+
+func TestDecisionsTotalMetric(t *testing.T) {
+	f := newTestFilter(t)
+
+	before := testutil.ToFloat64(decisionsTotal.WithLabelValues("blocked", "UNKNOWN"))
+	f.IsAllowed("8.8.4.4") // no country DB configured -> unknown-country, blocked
+	after := testutil.ToFloat64(decisionsTotal.WithLabelValues("blocked", "UNKNOWN"))
+
+	if delta := after - before; delta != 1 {
+		t.Fatalf("got decisionsTotal{blocked,UNKNOWN} delta %v, want 1", delta)
+	}
+}
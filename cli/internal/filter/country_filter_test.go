@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2026, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package filter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCidrRulesLongestPrefixWins(t *testing.T) {
+	var rules cidrRules
+	if err := rules.add("10.0.0.0/8", ruleBlock); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := rules.add("10.1.2.0/24", ruleAllow); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	action, network, matched := rules.lookup(net.ParseIP("10.1.2.3"))
+	if !matched || action != ruleAllow || network.String() != "10.1.2.0/24" {
+		t.Fatalf("got action=%v network=%v matched=%v, want the more specific /24 allow", action, network, matched)
+	}
+
+	action, network, matched = rules.lookup(net.ParseIP("10.9.9.9"))
+	if !matched || action != ruleBlock || network.String() != "10.0.0.0/8" {
+		t.Fatalf("got action=%v network=%v matched=%v, want the /8 block", action, network, matched)
+	}
+}
+
+func TestCidrRulesReAddSameNetworkReplaces(t *testing.T) {
+	var rules cidrRules
+	if err := rules.add("1.2.3.4/32", ruleAllow); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := rules.add("1.2.3.4/32", ruleBlock); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	action, _, matched := rules.lookup(net.ParseIP("1.2.3.4"))
+	if !matched || action != ruleBlock {
+		t.Fatalf("got action=%v matched=%v, want the later BlockIP call to win over the earlier AllowIP", action, matched)
+	}
+	if got := len(rules.v4); got != 1 {
+		t.Fatalf("got %d rules for the same network, want 1 (replaced, not duplicated)", got)
+	}
+}
+
+func TestCidrRulesEqualLengthTieBreaksToMostRecent(t *testing.T) {
+	var rules cidrRules
+	if err := rules.add("1.2.3.0/24", ruleAllow); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := rules.add("1.2.3.0/24", ruleBlock); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := rules.add("1.2.4.0/24", ruleAllow); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	action, network, matched := rules.lookup(net.ParseIP("1.2.4.1"))
+	if !matched || action != ruleAllow || network.String() != "1.2.4.0/24" {
+		t.Fatalf("got action=%v network=%v matched=%v, want the most recently added /24 to be found first", action, network, matched)
+	}
+	if got := rules.v4[0].network.String(); got != "1.2.4.0/24" {
+		t.Fatalf("got first rule %s, want the most recently added /24 (1.2.4.0/24) ordered ahead of the older one", got)
+	}
+}
+
+func newTestFilter(t *testing.T) *CountryFilter {
+	t.Helper()
+	f, err := NewFilter(Config{})
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	return f
+}
+
+func TestAllowIPThenBlockIPPurgesCache(t *testing.T) {
+	f := newTestFilter(t)
+
+	if err := f.AllowIP("1.2.3.4/32"); err != nil {
+		t.Fatalf("AllowIP: %v", err)
+	}
+	if d := f.IsAllowed("1.2.3.4"); !d.Allowed {
+		t.Fatalf("got Allowed=%v after AllowIP, want true", d.Allowed)
+	}
+	if stats := f.CacheStats(); stats.Size != 1 {
+		t.Fatalf("got cache size %d, want 1 after the first lookup", stats.Size)
+	}
+
+	if err := f.BlockIP("1.2.3.4/32"); err != nil {
+		t.Fatalf("BlockIP: %v", err)
+	}
+	if d := f.IsAllowed("1.2.3.4"); d.Allowed {
+		t.Fatalf("got Allowed=%v after BlockIP, want false: BlockIP must purge the stale cached decision", d.Allowed)
+	}
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	f := newTestFilter(t)
+	if err := f.AllowIP("1.2.3.4/32"); err != nil {
+		t.Fatalf("AllowIP: %v", err)
+	}
+
+	f.IsAllowed("1.2.3.4") // miss, populates the cache
+	f.IsAllowed("1.2.3.4") // hit
+
+	stats := f.CacheStats()
+	if stats.Misses != 1 {
+		t.Fatalf("got %d misses, want 1", stats.Misses)
+	}
+	if stats.Hits != 1 {
+		t.Fatalf("got %d hits, want 1", stats.Hits)
+	}
+}
+
+func TestMutatorsPurgeCache(t *testing.T) {
+	mutators := map[string]func(f *CountryFilter){
+		"AllowCountry":      func(f *CountryFilter) { f.AllowCountry("US") },
+		"BlockCountry":      func(f *CountryFilter) { f.BlockCountry("US") },
+		"SetBlockByDefault": func(f *CountryFilter) { f.SetBlockByDefault(false) },
+		"AllowIP":           func(f *CountryFilter) { f.AllowIP("9.9.9.0/24") },
+		"BlockIP":           func(f *CountryFilter) { f.BlockIP("9.9.9.0/24") },
+	}
+
+	for name, mutate := range mutators {
+		t.Run(name, func(t *testing.T) {
+			f := newTestFilter(t)
+
+			// No country database is configured, so this resolves to
+			// "unknown-country" and is still cached, same as the CIDR,
+			// relay and country decisions.
+			f.IsAllowed("8.8.8.8")
+			if stats := f.CacheStats(); stats.Size != 1 {
+				t.Fatalf("got cache size %d after the first lookup, want 1", stats.Size)
+			}
+
+			mutate(f)
+
+			if stats := f.CacheStats(); stats.Size != 0 {
+				t.Fatalf("got cache size %d after mutation, want 0: stale decisions must be purged on every rule change", stats.Size)
+			}
+		})
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	f := newTestFilter(t)
+
+	cases := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"RFC1918 10/8", "10.1.2.3", true},
+		{"RFC1918 172.16/12", "172.16.5.5", true},
+		{"RFC1918 192.168/16", "192.168.1.1", true},
+		{"RFC6598 CGNAT", "100.64.0.1", true},
+		{"IPv4 loopback", "127.0.0.1", true},
+		{"IPv4 link-local", "169.254.1.1", true},
+		{"RFC5737 doc range", "192.0.2.1", true},
+		{"IPv6 loopback", "::1", true},
+		{"IPv6 link-local", "fe80::1", true},
+		{"RFC4193 ULA", "fc00::1", true},
+		{"RFC3849 IPv6 doc range", "2001:db8::1", true},
+		{"IPv4 link-local multicast", "224.0.0.251", true},
+		{"IPv6 link-local multicast", "ff02::1", true},
+		{"public IPv4", "8.8.8.8", false},
+		{"public IPv6", "2001:4860:4860::8888", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip := net.ParseIP(tc.ip)
+			if ip == nil {
+				t.Fatalf("net.ParseIP(%q) returned nil", tc.ip)
+			}
+			if got := f.isPrivateIP(ip); got != tc.want {
+				t.Errorf("isPrivateIP(%q) = %v, want %v", tc.ip, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddRelayCIDRExtendsClassification(t *testing.T) {
+	f := newTestFilter(t)
+
+	if got := f.isPrivateIP(net.ParseIP("1.1.1.1")); got {
+		t.Fatalf("got isPrivateIP=%v before AddRelayCIDR, want false", got)
+	}
+
+	if err := f.AddRelayCIDR("1.1.1.0/24"); err != nil {
+		t.Fatalf("AddRelayCIDR: %v", err)
+	}
+	if got := f.isPrivateIP(net.ParseIP("1.1.1.1")); !got {
+		t.Fatalf("got isPrivateIP=%v after AddRelayCIDR, want true", got)
+	}
+}
+
+func TestAddRelayCIDRPurgesCache(t *testing.T) {
+	f := newTestFilter(t)
+
+	if d := f.IsAllowed("1.1.1.1"); d.Allowed {
+		t.Fatalf("got Allowed=%v before AddRelayCIDR, want false (not yet classified as relay)", d.Allowed)
+	}
+
+	if err := f.AddRelayCIDR("1.1.1.0/24"); err != nil {
+		t.Fatalf("AddRelayCIDR: %v", err)
+	}
+	if d := f.IsAllowed("1.1.1.1"); !d.Allowed || d.Reason != "relay" {
+		t.Fatalf("got Allowed=%v Reason=%q after AddRelayCIDR, want a fresh relay decision, not the stale cached one", d.Allowed, d.Reason)
+	}
+}